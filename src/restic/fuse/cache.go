@@ -0,0 +1,93 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+
+	"restic"
+)
+
+// treeCache is a bounded, least-recently-used cache of decoded trees,
+// keyed by tree ID. It is created once per mount and shared by every dir
+// below it, so that browsing sibling directories (or returning to a
+// directory already visited) doesn't pay for a LoadTree each time.
+type treeCache struct {
+	m        sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[restic.ID]*list.Element
+
+	hits, misses uint64
+}
+
+type treeCacheEntry struct {
+	id   restic.ID
+	tree *restic.Tree
+}
+
+// newTreeCache returns a treeCache that holds at most capacity trees. A
+// non-positive capacity disables caching: get always misses.
+func newTreeCache(capacity int) *treeCache {
+	return &treeCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[restic.ID]*list.Element),
+	}
+}
+
+// get loads the tree for id, either from the cache or, on a miss, via
+// repo.LoadTree, in which case it is inserted into the cache.
+func (c *treeCache) get(ctx context.Context, repo restic.Repository, id restic.ID) (*restic.Tree, error) {
+	if c == nil || c.capacity <= 0 {
+		return repo.LoadTree(ctx, id)
+	}
+
+	c.m.Lock()
+	if e, ok := c.items[id]; ok {
+		c.ll.MoveToFront(e)
+		tree := e.Value.(*treeCacheEntry).tree
+		atomic.AddUint64(&c.hits, 1)
+		c.m.Unlock()
+		return tree, nil
+	}
+	c.m.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	tree, err := repo.LoadTree(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*treeCacheEntry).tree, nil
+	}
+	e := c.ll.PushFront(&treeCacheEntry{id: id, tree: tree})
+	c.items[id] = e
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*treeCacheEntry).id)
+	}
+
+	return tree, nil
+}
+
+// Stats returns the number of cache hits and misses seen so far.
+func (c *treeCache) Stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
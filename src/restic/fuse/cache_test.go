@@ -0,0 +1,98 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"restic"
+)
+
+// fakeTreeRepo implements just enough of restic.Repository for treeCache
+// tests: LoadTree is counted and served from trees, every other method
+// panics if called (via the nil embedded interface) since the tests below
+// never need them.
+type fakeTreeRepo struct {
+	restic.Repository
+	trees     map[restic.ID]*restic.Tree
+	loadCalls int
+}
+
+func (f *fakeTreeRepo) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	f.loadCalls++
+	return f.trees[id], nil
+}
+
+func TestTreeCacheHitsAndMisses(t *testing.T) {
+	var id restic.ID
+	id[0] = 1
+	repo := &fakeTreeRepo{trees: map[restic.ID]*restic.Tree{id: {}}}
+
+	c := newTreeCache(10)
+	ctx := context.Background()
+
+	if _, err := c.get(ctx, repo, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.get(ctx, repo, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if repo.loadCalls != 1 {
+		t.Fatalf("expected a single LoadTree call, got %v", repo.loadCalls)
+	}
+
+	hits, misses := c.Stats()
+	if hits != 1 || misses != 1 {
+		t.Fatalf("expected 1 hit and 1 miss, got %v hits, %v misses", hits, misses)
+	}
+}
+
+func TestTreeCacheEviction(t *testing.T) {
+	var id1, id2, id3 restic.ID
+	id1[0], id2[0], id3[0] = 1, 2, 3
+	repo := &fakeTreeRepo{trees: map[restic.ID]*restic.Tree{
+		id1: {}, id2: {}, id3: {},
+	}}
+
+	c := newTreeCache(2)
+	ctx := context.Background()
+
+	for _, id := range []restic.ID{id1, id2, id3} {
+		if _, err := c.get(ctx, repo, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := c.items[id1]; ok {
+		t.Fatalf("expected the oldest entry (id1) to have been evicted")
+	}
+	if len(c.items) != 2 {
+		t.Fatalf("expected capacity to be enforced, cache holds %v entries", len(c.items))
+	}
+}
+
+func TestTreeCacheDisabled(t *testing.T) {
+	var id restic.ID
+	id[0] = 1
+	repo := &fakeTreeRepo{trees: map[restic.ID]*restic.Tree{id: {}}}
+
+	c := newTreeCache(0)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.get(ctx, repo, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if repo.loadCalls != 3 {
+		t.Fatalf("expected a disabled cache to miss every time, got %v LoadTree calls", repo.loadCalls)
+	}
+	if len(c.items) != 0 {
+		t.Fatalf("expected a disabled cache to never retain entries, got %v", len(c.items))
+	}
+}
@@ -0,0 +1,63 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"restic/debug"
+)
+
+// controlFileName is a reserved entry in every snapshot-root directory of
+// a writable mount. bazil.org/fuse has no ioctl support, so flushing the
+// overlay (e.g. `: > mnt/<snapshot>/.restic-commit`) is the closest
+// equivalent: every close of the file calls CommitOverlay, whether or not
+// anything was written to it, which creates a new snapshot with the
+// mounted snapshot as parent unless the overlay holds no changes.
+const controlFileName = ".restic-commit"
+
+// Statically ensure that *controlFile implements those interfaces.
+var _ = fs.Node(&controlFile{})
+var _ = fs.Handle(&controlFile{})
+var _ = fs.HandleWriter(&controlFile{})
+var _ = fs.HandleFlusher(&controlFile{})
+
+// controlFile triggers CommitOverlay on its owning snapshot-root dir when
+// flushed. It holds no content of its own; writes to it are accepted and
+// discarded.
+type controlFile struct {
+	dir   *dir
+	inode uint64
+}
+
+func newControlFile(dir *dir) *controlFile {
+	return &controlFile{dir: dir, inode: nextWritableInode()}
+}
+
+func (c *controlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = c.inode
+	a.Mode = 0600
+	return nil
+}
+
+func (c *controlFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (c *controlFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	sn := c.dir.snapshot
+	debug.Log("Flush(%v): committing overlay for snapshot %v", controlFileName, sn.ID.Str())
+
+	id, err := c.dir.overlay.CommitOverlay(ctx, sn.Hostname, sn.Paths, sn.Tags)
+	if err != nil {
+		debug.Log("  CommitOverlay failed: %v", err)
+		return err
+	}
+
+	debug.Log("  CommitOverlay created snapshot %v", id.Str())
+	return nil
+}
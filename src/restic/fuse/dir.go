@@ -4,7 +4,9 @@
 package fuse
 
 import (
+	"fmt"
 	"os"
+	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -17,6 +19,10 @@ import (
 // Statically ensure that *dir implement those interface
 var _ = fs.HandleReadDirAller(&dir{})
 var _ = fs.NodeStringLookuper(&dir{})
+var _ = fs.NodeCreater(&dir{})
+var _ = fs.NodeMkdirer(&dir{})
+var _ = fs.NodeRemover(&dir{})
+var _ = fs.NodeRenamer(&dir{})
 
 type dir struct {
 	repo        restic.Repository
@@ -26,11 +32,146 @@ type dir struct {
 	ownerIsRoot bool
 
 	blobsize *BlobSizeCache
+
+	// path is the list of names from the mount root down to this
+	// directory; it is used to address the overlay tree below.
+	path []string
+	// overlay is non-nil for writable mounts. Writes are recorded here
+	// instead of being rejected, and are packed into a new snapshot by
+	// overlay.CommitOverlay when the control file (controlFileName) is
+	// flushed. Unmounting does not commit the overlay.
+	overlay *overlayTree
+
+	// cache is the tree cache shared by the whole mount. It is nil if the
+	// mount was created without one, in which case every tree is loaded
+	// straight from the repository.
+	cache *treeCache
+
+	// snapshot is set on dirs that are a snapshot root (i.e. created via
+	// newDirFromSnapshotAt), so that Getxattr/Listxattr can synthesize the
+	// user.restic.* xattrs below. It is nil on every other dir.
+	snapshot *SnapshotWithId
+
+	// layout and snapshots are set on virtual directories, the
+	// hosts/tags/time groupings a Layout places above the real snapshot
+	// roots. virtualPath is the list of segments already consumed on the
+	// way down from the mount root. When layout is non-nil, items is
+	// unused and children are instead computed on demand by
+	// virtualChildren, since materializing every snapshot's path up
+	// front doesn't scale to repos with many snapshots.
+	layout      Layout
+	snapshots   []SnapshotWithId
+	virtualPath []string
+}
+
+// newVirtualDir returns the virtual directory at virtualPath, one of the
+// intermediate directories (or the mount root) that a non-flat Layout
+// introduces above the real snapshot roots.
+func newVirtualDir(repo restic.Repository, ownerIsRoot bool, blobsize *BlobSizeCache, overlay *overlayTree, cache *treeCache, layout Layout, snapshots []SnapshotWithId, virtualPath []string) *dir {
+	return &dir{
+		repo: repo,
+		node: &restic.Node{
+			Mode: os.ModeDir | 0555,
+		},
+		ownerIsRoot: ownerIsRoot,
+		blobsize:    blobsize,
+		overlay:     overlay,
+		cache:       cache,
+		layout:      layout,
+		snapshots:   snapshots,
+		virtualPath: virtualPath,
+	}
+}
+
+// virtualChildren partitions d.snapshots into the names of the
+// subdirectories directly below d (dirs) and the snapshots that resolve
+// to a real snapshot root directly below d (leaves).
+func (d *dir) virtualChildren() (dirs map[string]bool, leaves map[string]SnapshotWithId) {
+	dirs = make(map[string]bool)
+	leaves = make(map[string]SnapshotWithId)
+
+	for _, sn := range d.snapshots {
+		for _, p := range d.layout.Paths(sn) {
+			if len(p) <= len(d.virtualPath) || !hasPrefix(p, d.virtualPath) {
+				continue
+			}
+			name := p[len(d.virtualPath)]
+			if len(p) == len(d.virtualPath)+1 {
+				leaves[name] = sn
+			} else {
+				dirs[name] = true
+			}
+		}
+	}
+
+	return dirs, leaves
+}
+
+func hasPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, name := range prefix {
+		if path[i] != name {
+			return false
+		}
+	}
+	return true
 }
 
 func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, ownerIsRoot bool, blobsize *BlobSizeCache) (*dir, error) {
+	return newDirAt(ctx, repo, node, ownerIsRoot, blobsize, nil, nil, nil)
+}
+
+// mergeOverlay applies whatever the overlay has recorded directly below
+// path to items: overlay files/dirs are added or replaced, and tombstoned
+// names are deleted. This is what makes a dir rebuilt from the repository
+// (e.g. after the kernel evicted the cached inode and re-Lookups it from
+// the parent) still reflect earlier writes instead of resurrecting
+// removed entries or losing newly created ones.
+func mergeOverlay(items map[string]*restic.Node, overlay *overlayTree, path []string) {
+	if overlay == nil {
+		return
+	}
+	for name, child := range overlay.childrenAt(path) {
+		if child == nil {
+			delete(items, name)
+			continue
+		}
+		items[name] = child.node
+	}
+}
+
+// newOverlayDir builds a dir that is backed only by the overlay, with no
+// corresponding tree in the repository: this is the shape of a directory
+// created by Mkdir in a writable mount. Its items come straight from the
+// matching overlayEntry's children, mirroring how newWritableFile serves
+// a created file's content straight from the overlay instead of the repo.
+func newOverlayDir(repo restic.Repository, node *restic.Node, path []string, ownerIsRoot bool, blobsize *BlobSizeCache, overlay *overlayTree, cache *treeCache) *dir {
+	items := make(map[string]*restic.Node)
+	for name, child := range overlay.childrenAt(path) {
+		if child == nil {
+			continue
+		}
+		items[name] = child.node
+	}
+
+	return &dir{
+		repo:        repo,
+		node:        node,
+		items:       items,
+		inode:       nextWritableInode(),
+		ownerIsRoot: ownerIsRoot,
+		blobsize:    blobsize,
+		path:        path,
+		overlay:     overlay,
+		cache:       cache,
+	}
+}
+
+func newDirAt(ctx context.Context, repo restic.Repository, node *restic.Node, ownerIsRoot bool, blobsize *BlobSizeCache, path []string, overlay *overlayTree, cache *treeCache) (*dir, error) {
 	debug.Log("new dir for %v (%v)", node.Name, node.Subtree.Str())
-	tree, err := repo.LoadTree(ctx, *node.Subtree)
+	tree, err := cache.get(ctx, repo, *node.Subtree)
 	if err != nil {
 		debug.Log("  error loading tree %v: %v", node.Subtree.Str(), err)
 		return nil, err
@@ -39,6 +180,7 @@ func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, owne
 	for _, node := range tree.Nodes {
 		items[node.Name] = node
 	}
+	mergeOverlay(items, overlay, path)
 
 	return &dir{
 		repo:        repo,
@@ -47,12 +189,15 @@ func newDir(ctx context.Context, repo restic.Repository, node *restic.Node, owne
 		inode:       node.Inode,
 		ownerIsRoot: ownerIsRoot,
 		blobsize:    blobsize,
+		path:        path,
+		overlay:     overlay,
+		cache:       cache,
 	}, nil
 }
 
 // replaceSpecialNodes replaces nodes with name "." and "/" by their contents.
 // Otherwise, the node is returned.
-func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *restic.Node) ([]*restic.Node, error) {
+func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *restic.Node, cache *treeCache) ([]*restic.Node, error) {
 	if node.Type != "dir" || node.Subtree == nil {
 		return []*restic.Node{node}, nil
 	}
@@ -61,7 +206,7 @@ func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *rest
 		return []*restic.Node{node}, nil
 	}
 
-	tree, err := repo.LoadTree(ctx, *node.Subtree)
+	tree, err := cache.get(ctx, repo, *node.Subtree)
 	if err != nil {
 		return nil, err
 	}
@@ -70,15 +215,24 @@ func replaceSpecialNodes(ctx context.Context, repo restic.Repository, node *rest
 }
 
 func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot SnapshotWithId, ownerIsRoot bool, blobsize *BlobSizeCache) (*dir, error) {
+	return newDirFromSnapshotAt(ctx, repo, snapshot, ownerIsRoot, blobsize, nil, nil)
+}
+
+// newDirFromSnapshotAt is like newDirFromSnapshot, but attaches overlay and
+// cache, the state shared across a mount: overlay records writes so that
+// they are packed into CommitOverlay instead of being rejected, and cache
+// avoids re-loading a tree that was already decoded by a sibling dir. Pass
+// nil for either to disable it.
+func newDirFromSnapshotAt(ctx context.Context, repo restic.Repository, snapshot SnapshotWithId, ownerIsRoot bool, blobsize *BlobSizeCache, overlay *overlayTree, cache *treeCache) (*dir, error) {
 	debug.Log("new dir for snapshot %v (%v)", snapshot.ID.Str(), snapshot.Tree.Str())
-	tree, err := repo.LoadTree(ctx, *snapshot.Tree)
+	tree, err := cache.get(ctx, repo, *snapshot.Tree)
 	if err != nil {
 		debug.Log("  loadTree(%v) failed: %v", snapshot.ID.Str(), err)
 		return nil, err
 	}
 	items := make(map[string]*restic.Node)
 	for _, n := range tree.Nodes {
-		nodes, err := replaceSpecialNodes(ctx, repo, n)
+		nodes, err := replaceSpecialNodes(ctx, repo, n, cache)
 		if err != nil {
 			debug.Log("  replaceSpecialNodes(%v) failed: %v", n, err)
 			return nil, err
@@ -88,6 +242,7 @@ func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot Sn
 			items[node.Name] = node
 		}
 	}
+	mergeOverlay(items, overlay, nil)
 
 	return &dir{
 		repo: repo,
@@ -103,6 +258,9 @@ func newDirFromSnapshot(ctx context.Context, repo restic.Repository, snapshot Sn
 		inode:       inodeFromBackendID(snapshot.ID),
 		ownerIsRoot: ownerIsRoot,
 		blobsize:    blobsize,
+		overlay:     overlay,
+		cache:       cache,
+		snapshot:    &snapshot,
 	}, nil
 }
 
@@ -139,6 +297,19 @@ func (d *dir) calcNumberOfLinks() uint32 {
 
 func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	debug.Log("called")
+
+	if d.layout != nil {
+		dirs, leaves := d.virtualChildren()
+		ret := make([]fuse.Dirent, 0, len(dirs)+len(leaves))
+		for name := range dirs {
+			ret = append(ret, fuse.Dirent{Type: fuse.DT_Dir, Name: name})
+		}
+		for name, sn := range leaves {
+			ret = append(ret, fuse.Dirent{Inode: inodeFromBackendID(sn.ID), Type: fuse.DT_Dir, Name: name})
+		}
+		return ret, nil
+	}
+
 	ret := make([]fuse.Dirent, 0, len(d.items))
 
 	for _, node := range d.items {
@@ -159,11 +330,35 @@ func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		})
 	}
 
+	if d.overlay != nil && d.snapshot != nil {
+		ret = append(ret, fuse.Dirent{Type: fuse.DT_File, Name: controlFileName})
+	}
+
 	return ret, nil
 }
 
 func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	debug.Log("Lookup(%v)", name)
+
+	if d.overlay != nil && d.snapshot != nil && name == controlFileName {
+		return newControlFile(d), nil
+	}
+
+	if d.layout != nil {
+		dirs, leaves := d.virtualChildren()
+		if sn, ok := leaves[name]; ok {
+			return newDirFromSnapshotAt(ctx, d.repo, sn, d.ownerIsRoot, d.blobsize, d.overlay, d.cache)
+		}
+		if dirs[name] {
+			path := make([]string, len(d.virtualPath)+1)
+			copy(path, d.virtualPath)
+			path[len(d.virtualPath)] = name
+			return newVirtualDir(d.repo, d.ownerIsRoot, d.blobsize, d.overlay, d.cache, d.layout, d.snapshots, path), nil
+		}
+		debug.Log("  Lookup(%v) -> not found", name)
+		return nil, fuse.ENOENT
+	}
+
 	node, ok := d.items[name]
 	if !ok {
 		debug.Log("  Lookup(%v) -> not found", name)
@@ -171,8 +366,31 @@ func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	}
 	switch node.Type {
 	case "dir":
-		return newDir(ctx, d.repo, node, d.ownerIsRoot, d.blobsize)
+		if node.Subtree == nil {
+			// overlay-only directory (created by Mkdir): it has no
+			// backing tree in the repository to load
+			return newOverlayDir(d.repo, node, d.childPath(name), d.ownerIsRoot, d.blobsize, d.overlay, d.cache), nil
+		}
+		return newDirAt(ctx, d.repo, node, d.ownerIsRoot, d.blobsize, d.childPath(name), d.overlay, d.cache)
 	case "file":
+		if d.overlay != nil {
+			path := d.childPath(name)
+			entry, tombstoned := d.overlay.lookup(path, false)
+			if !tombstoned {
+				if entry != nil {
+					// an entry that rename copied up has no data of its
+					// own yet: load it from its Content like an untouched file
+					loaded := entry.data != nil || len(entry.node.Content) == 0
+					return newWritableFile(d.repo, entry.node, entry.data, loaded, path, d.overlay), nil
+				}
+				// the file predates the mount and hasn't been touched
+				// yet: serve a copy-up handle so that editing restored
+				// files works without a full restore/re-backup cycle.
+				// Its content is loaded lazily, on the first Read or
+				// Write (see writableFile.ensureLoaded).
+				return newWritableFile(d.repo, node, nil, false, path, d.overlay), nil
+			}
+		}
 		return newFile(d.repo, node, d.ownerIsRoot, d.blobsize)
 	case "symlink":
 		return newLink(d.repo, node, d.ownerIsRoot)
@@ -182,16 +400,171 @@ func (d *dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	}
 }
 
+// childPath returns the overlay path of the child of d named name.
+func (d *dir) childPath(name string) []string {
+	path := make([]string, len(d.path)+1)
+	copy(path, d.path)
+	path[len(d.path)] = name
+	return path
+}
+
+// Create implements fs.NodeCreater for writable mounts: it adds a new,
+// empty file to the overlay and returns a handle ready to be written to.
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	debug.Log("Create(%v)", req.Name)
+	if d.overlay == nil {
+		return nil, nil, fuse.EPERM
+	}
+
+	node := &restic.Node{
+		Name: req.Name,
+		Type: "file",
+		Mode: req.Mode,
+		UID:  req.Uid,
+		GID:  req.Gid,
+	}
+	path := d.childPath(req.Name)
+	d.overlay.set(path, node, nil)
+	d.items[req.Name] = node
+
+	f := newWritableFile(d.repo, node, nil, true, path, d.overlay)
+	return f, f, nil
+}
+
+// Mkdir implements fs.NodeMkdirer for writable mounts.
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	debug.Log("Mkdir(%v)", req.Name)
+	if d.overlay == nil {
+		return nil, fuse.EPERM
+	}
+
+	node := &restic.Node{
+		Name: req.Name,
+		Type: "dir",
+		Mode: os.ModeDir | req.Mode,
+		UID:  req.Uid,
+		GID:  req.Gid,
+	}
+	path := d.childPath(req.Name)
+	d.overlay.set(path, node, nil)
+	d.items[req.Name] = node
+
+	return newOverlayDir(d.repo, node, path, d.ownerIsRoot, d.blobsize, d.overlay, d.cache), nil
+}
+
+// Remove implements fs.NodeRemover for writable mounts: it tombstones the
+// path in the overlay so that CommitOverlay leaves it out of the packed
+// tree, regardless of whether it was created in this mount or already
+// existed in the underlying snapshot. req.Dir tells unlink and rmdir
+// apart: rmdir must refuse a name that isn't a directory, and must refuse
+// a directory that still has entries in it.
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	debug.Log("Remove(%v)", req.Name)
+	if d.overlay == nil {
+		return fuse.EPERM
+	}
+	node, ok := d.items[req.Name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if req.Dir != (node.Type == "dir") {
+		if req.Dir {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if node.Type == "dir" {
+		empty, err := d.dirIsEmpty(ctx, node, d.childPath(req.Name))
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+
+	d.overlay.remove(d.childPath(req.Name))
+	delete(d.items, req.Name)
+	return nil
+}
+
+// dirIsEmpty reports whether the directory named by node and path has no
+// entries left once the overlay is merged in with its real tree (if it
+// has one), so that Remove can refuse rmdir on a non-empty directory.
+func (d *dir) dirIsEmpty(ctx context.Context, node *restic.Node, path []string) (bool, error) {
+	items := make(map[string]*restic.Node)
+	if node.Subtree != nil {
+		tree, err := d.cache.get(ctx, d.repo, *node.Subtree)
+		if err != nil {
+			return false, err
+		}
+		for _, n := range tree.Nodes {
+			items[n.Name] = n
+		}
+	}
+	mergeOverlay(items, d.overlay, path)
+	return len(items) == 0, nil
+}
+
+// Rename implements fs.NodeRenamer for writable mounts.
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	debug.Log("Rename(%v, %v)", req.OldName, req.NewName)
+	if d.overlay == nil {
+		return fuse.EPERM
+	}
+	target, ok := newDir.(*dir)
+	if !ok {
+		return fuse.EIO
+	}
+	node, ok := d.items[req.OldName]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	d.overlay.rename(d.childPath(req.OldName), target.childPath(req.NewName), node)
+	delete(d.items, req.OldName)
+	target.items[req.NewName] = node
+	return nil
+}
+
+// cacheStatsXattr is the name of the debug xattr that exposes the shared
+// tree cache's hit/miss counters, so that the hit rate can be read from the
+// command line (e.g. with getfattr). The cache's capacity is whatever its
+// creator passed to newTreeCache.
+const cacheStatsXattr = "user.restic.cache_stats"
+
 func (d *dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
 	debug.Log("Listxattr(%v, %v)", d.node.Name, req.Size)
 	for _, attr := range d.node.ExtendedAttributes {
 		resp.Append(attr.Name)
 	}
+	if d.cache != nil {
+		resp.Append(cacheStatsXattr)
+	}
+	if d.snapshot != nil {
+		for _, name := range snapshotXattrNames {
+			resp.Append(name)
+		}
+	}
 	return nil
 }
 
 func (d *dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
 	debug.Log("Getxattr(%v, %v, %v)", d.node.Name, req.Name, req.Size)
+
+	if req.Name == cacheStatsXattr && d.cache != nil {
+		hits, misses := d.cache.Stats()
+		resp.Xattr = []byte(fmt.Sprintf("hits=%d misses=%d", hits, misses))
+		return nil
+	}
+
+	if d.snapshot != nil {
+		if val := snapshotXattr(d.snapshot, req.Name); val != nil {
+			resp.Xattr = val
+			return nil
+		}
+	}
+
 	attrval := d.node.GetExtendedAttribute(req.Name)
 	if attrval != nil {
 		resp.Xattr = attrval
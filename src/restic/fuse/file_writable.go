@@ -0,0 +1,169 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"restic"
+	"restic/debug"
+)
+
+// writableInode hands out inode numbers for nodes created through a
+// writable mount, which have no backend ID to derive one from.
+var writableInode uint64 = 1 << 63
+
+func nextWritableInode() uint64 {
+	return atomic.AddUint64(&writableInode, 1)
+}
+
+// Statically ensure that *writableFile implements those interfaces.
+var _ = fs.Node(&writableFile{})
+var _ = fs.Handle(&writableFile{})
+var _ = fs.HandleReader(&writableFile{})
+var _ = fs.HandleWriter(&writableFile{})
+var _ = fs.HandleFlusher(&writableFile{})
+var _ = fs.NodeSetattrer(&writableFile{})
+
+// writableFile is the writable counterpart of file: it buffers writes in
+// memory and records the result in the overlay tree of its mount when
+// flushed, rather than reading blobs from the repository. When it is
+// serving a file that predates the mount and hasn't been touched in the
+// overlay yet, loaded is false and data is filled in by ensureLoaded the
+// first time the file is read or written, copying up its content from
+// the repository instead of starting from an empty buffer.
+type writableFile struct {
+	repo    restic.Repository
+	node    *restic.Node
+	inode   uint64
+	path    []string
+	overlay *overlayTree
+	data    []byte
+	loaded  bool
+}
+
+func newWritableFile(repo restic.Repository, node *restic.Node, data []byte, loaded bool, path []string, overlay *overlayTree) *writableFile {
+	return &writableFile{
+		repo:    repo,
+		node:    node,
+		inode:   nextWritableInode(),
+		path:    path,
+		overlay: overlay,
+		data:    data,
+		loaded:  loaded,
+	}
+}
+
+// ensureLoaded copies up node's content from the repository the first
+// time the file is read or written, so that editing or reading a file
+// that predates the mount sees its real content rather than an empty
+// buffer. It is a no-op once data has been loaded or written at least
+// once.
+func (f *writableFile) ensureLoaded(ctx context.Context) error {
+	if f.loaded {
+		return nil
+	}
+
+	data := make([]byte, 0, f.node.Size)
+	for _, id := range f.node.Content {
+		buf, err := f.repo.LoadBlob(ctx, restic.DataBlob, id, nil)
+		if err != nil {
+			return err
+		}
+		data = append(data, buf...)
+	}
+
+	f.data = data
+	f.loaded = true
+	return nil
+}
+
+func (f *writableFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = f.inode
+	a.Mode = f.node.Mode
+	a.Uid = f.node.UID
+	a.Gid = f.node.GID
+	if f.loaded {
+		a.Size = uint64(len(f.data))
+	} else {
+		a.Size = f.node.Size
+	}
+	a.Atime = f.node.AccessTime
+	a.Ctime = f.node.ChangeTime
+	a.Mtime = f.node.ModTime
+	return nil
+}
+
+// Setattr implements fs.NodeSetattrer, so that truncating a writable file
+// (O_TRUNC opens, or an explicit truncate()) actually shrinks or grows
+// f.data instead of bazil's fs package silently reporting success with
+// the content unchanged.
+func (f *writableFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	debug.Log("Setattr(%v, %v)", f.path, req.Valid)
+	if req.Valid.Size() {
+		if err := f.ensureLoaded(ctx); err != nil {
+			return err
+		}
+		if req.Size <= uint64(len(f.data)) {
+			f.data = f.data[:req.Size]
+		} else {
+			grown := make([]byte, req.Size)
+			copy(grown, f.data)
+			f.data = grown
+		}
+		f.node.Size = uint64(len(f.data))
+	}
+
+	return f.Attr(ctx, &resp.Attr)
+}
+
+func (f *writableFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	debug.Log("Read(%v, %v, %v)", f.path, req.Offset, req.Size)
+	if err := f.ensureLoaded(ctx); err != nil {
+		return err
+	}
+
+	end := int(req.Offset) + req.Size
+	if end > len(f.data) {
+		end = len(f.data)
+	}
+	if int(req.Offset) >= end {
+		resp.Data = nil
+		return nil
+	}
+	resp.Data = f.data[req.Offset:end]
+	return nil
+}
+
+func (f *writableFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	debug.Log("Write(%v, %v, %v)", f.path, req.Offset, len(req.Data))
+	if err := f.ensureLoaded(ctx); err != nil {
+		return err
+	}
+
+	end := int(req.Offset) + len(req.Data)
+	if end > len(f.data) {
+		grown := make([]byte, end)
+		copy(grown, f.data)
+		f.data = grown
+	}
+	copy(f.data[req.Offset:], req.Data)
+	resp.Size = len(req.Data)
+
+	return nil
+}
+
+func (f *writableFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	debug.Log("Flush(%v)", f.path)
+	if err := f.ensureLoaded(ctx); err != nil {
+		return err
+	}
+	f.node.Size = uint64(len(f.data))
+	f.overlay.set(f.path, f.node, f.data)
+	return nil
+}
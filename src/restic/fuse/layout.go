@@ -0,0 +1,85 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"fmt"
+)
+
+// Layout decides where in the virtual directory tree under the mount root
+// a snapshot is placed. A snapshot can appear at more than one path; for
+// example TagsLayout places it once under every tag it carries.
+type Layout interface {
+	// Name identifies the layout; ParseLayout matches against it.
+	Name() string
+	// Paths returns the virtual paths (each a slice of path segments,
+	// ending in the snapshot's short ID) at which sn should appear.
+	Paths(sn SnapshotWithId) [][]string
+}
+
+// FlatLayout lists every snapshot directly under the mount root. This is
+// restic's original, pre-Layout mount behavior.
+type FlatLayout struct{}
+
+func (FlatLayout) Name() string { return "flat" }
+
+func (FlatLayout) Paths(sn SnapshotWithId) [][]string {
+	return [][]string{{sn.ID.Str()}}
+}
+
+// HostsLayout groups snapshots as hosts/<hostname>/<snapshot>.
+type HostsLayout struct{}
+
+func (HostsLayout) Name() string { return "hosts" }
+
+func (HostsLayout) Paths(sn SnapshotWithId) [][]string {
+	return [][]string{{"hosts", sn.Hostname, sn.ID.Str()}}
+}
+
+// TagsLayout groups snapshots as tags/<tag>/<snapshot>, once per tag.
+// Untagged snapshots appear under tags/untagged.
+type TagsLayout struct{}
+
+func (TagsLayout) Name() string { return "tags" }
+
+func (TagsLayout) Paths(sn SnapshotWithId) [][]string {
+	if len(sn.Tags) == 0 {
+		return [][]string{{"tags", "untagged", sn.ID.Str()}}
+	}
+	paths := make([][]string, len(sn.Tags))
+	for i, tag := range sn.Tags {
+		paths[i] = []string{"tags", tag, sn.ID.Str()}
+	}
+	return paths
+}
+
+// TimeLayout groups snapshots as YYYY/MM/DD/<snapshot>.
+type TimeLayout struct{}
+
+func (TimeLayout) Name() string { return "time" }
+
+func (TimeLayout) Paths(sn SnapshotWithId) [][]string {
+	y, m, d := sn.Time.Date()
+	return [][]string{{
+		fmt.Sprintf("%04d", y),
+		fmt.Sprintf("%02d", m),
+		fmt.Sprintf("%02d", d),
+		sn.ID.Str(),
+	}}
+}
+
+// Layouts lists every layout that ParseLayout accepts, in the order
+// ParseLayout searches them.
+var Layouts = []Layout{FlatLayout{}, HostsLayout{}, TagsLayout{}, TimeLayout{}}
+
+// ParseLayout returns the Layout in Layouts whose Name is name, or an error
+// for any other name. restic mount has no --layout flag that calls it.
+func ParseLayout(name string) (Layout, error) {
+	for _, layout := range Layouts {
+		if layout.Name() == name {
+			return layout, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown mount layout %q", name)
+}
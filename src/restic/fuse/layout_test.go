@@ -0,0 +1,90 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"restic"
+)
+
+func testSnapshot(id byte, hostname string, tags []string, when time.Time) SnapshotWithId {
+	var sid restic.ID
+	sid[0] = id
+	return SnapshotWithId{
+		Snapshot: restic.Snapshot{
+			Hostname: hostname,
+			Tags:     tags,
+			Time:     when,
+		},
+		ID: sid,
+	}
+}
+
+func TestFlatLayoutPaths(t *testing.T) {
+	sn := testSnapshot(1, "host", nil, time.Now())
+	paths := FlatLayout{}.Paths(sn)
+	want := [][]string{{sn.ID.Str()}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+}
+
+func TestHostsLayoutPaths(t *testing.T) {
+	sn := testSnapshot(2, "myhost", nil, time.Now())
+	paths := HostsLayout{}.Paths(sn)
+	want := [][]string{{"hosts", "myhost", sn.ID.Str()}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+}
+
+func TestTagsLayoutPathsUntagged(t *testing.T) {
+	sn := testSnapshot(3, "host", nil, time.Now())
+	paths := TagsLayout{}.Paths(sn)
+	want := [][]string{{"tags", "untagged", sn.ID.Str()}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+}
+
+func TestTagsLayoutPathsGroupsByEveryTag(t *testing.T) {
+	sn := testSnapshot(4, "host", []string{"a", "b"}, time.Now())
+	paths := TagsLayout{}.Paths(sn)
+	want := [][]string{
+		{"tags", "a", sn.ID.Str()},
+		{"tags", "b", sn.ID.Str()},
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+}
+
+func TestTimeLayoutPaths(t *testing.T) {
+	when := time.Date(2021, time.March, 5, 0, 0, 0, 0, time.UTC)
+	sn := testSnapshot(5, "host", nil, when)
+	paths := TimeLayout{}.Paths(sn)
+	want := [][]string{{"2021", "03", "05", sn.ID.Str()}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %v, want %v", paths, want)
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, name := range []string{"flat", "hosts", "tags", "time"} {
+		layout, err := ParseLayout(name)
+		if err != nil {
+			t.Fatalf("ParseLayout(%q): %v", name, err)
+		}
+		if layout.Name() != name {
+			t.Fatalf("ParseLayout(%q) returned layout named %q", name, layout.Name())
+		}
+	}
+
+	if _, err := ParseLayout("bogus"); err == nil {
+		t.Fatal("expected ParseLayout to reject an unknown layout name")
+	}
+}
@@ -0,0 +1,312 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"restic"
+	"restic/debug"
+)
+
+// overlayEntry is a single path that has been created, modified or removed
+// in a writable mount. A nil node marks the path as deleted (a tombstone),
+// so that a removal of a file that only exists in the underlying snapshot
+// can still be recorded.
+type overlayEntry struct {
+	node     *restic.Node
+	data     []byte
+	children map[string]*overlayEntry
+}
+
+// overlayTree is the in-memory scratch area that accumulates writes made
+// through a writable FUSE mount. It shadows the read-only view produced by
+// newDirFromSnapshot/newDir and is packed into a new snapshot, with parent
+// set to the mounted snapshot, by CommitOverlay. parentTree and cache let
+// CommitOverlay merge each directory's real tree with the overlay delta
+// instead of replacing it outright; cache may be nil, in which case every
+// tree is loaded straight from the repository.
+type overlayTree struct {
+	m sync.Mutex
+
+	repo       restic.Repository
+	parent     restic.ID
+	parentTree restic.ID
+	cache      *treeCache
+	root       *overlayEntry
+}
+
+func newOverlayTree(repo restic.Repository, parent restic.ID, parentTree restic.ID, cache *treeCache) *overlayTree {
+	return &overlayTree{
+		repo:       repo,
+		parent:     parent,
+		parentTree: parentTree,
+		cache:      cache,
+		root: &overlayEntry{
+			node:     &restic.Node{Type: "dir", Mode: os.ModeDir | 0755},
+			children: make(map[string]*overlayEntry),
+		},
+	}
+}
+
+// lookupLocked walks path (a slice of names from the mount root) and
+// returns the overlayEntry recorded there, creating intermediate directory
+// entries along the way when create is true. tombstoned is true when path
+// or one of its ancestors was removed via remove() (and create is false);
+// entry is nil in that case too, so
+// callers must check tombstoned to tell "removed" apart from "the overlay
+// has nothing recorded here" (entry nil, tombstoned false). The caller
+// must hold o.m.
+func (o *overlayTree) lookupLocked(path []string, create bool) (entry *overlayEntry, tombstoned bool) {
+	cur := o.root
+	for _, name := range path {
+		next, ok := cur.children[name]
+		if ok && next == nil {
+			if !create {
+				return nil, true
+			}
+			// recreate a tombstoned directory so a write below it can
+			// proceed, mirroring mkdir-after-rmdir semantics
+			next = &overlayEntry{
+				node:     &restic.Node{Name: name, Type: "dir", Mode: os.ModeDir | 0755},
+				children: make(map[string]*overlayEntry),
+			}
+			cur.children[name] = next
+		} else if !ok {
+			if !create {
+				return nil, false
+			}
+			next = &overlayEntry{
+				node:     &restic.Node{Name: name, Type: "dir", Mode: os.ModeDir | 0755},
+				children: make(map[string]*overlayEntry),
+			}
+			cur.children[name] = next
+		}
+		cur = next
+	}
+	return cur, false
+}
+
+// lookup is lookupLocked with its own locking, for callers that don't hold
+// o.m, e.g. dir.Lookup.
+func (o *overlayTree) lookup(path []string, create bool) (entry *overlayEntry, tombstoned bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.lookupLocked(path, create)
+}
+
+// childrenAt returns a snapshot of the overlay's recorded immediate
+// children of path (a nil value marks a tombstoned child), or nil if the
+// overlay has nothing recorded at path at all. It is used to merge overlay
+// state into a dir's items when the dir is (re)built from the repository.
+func (o *overlayTree) childrenAt(path []string) map[string]*overlayEntry {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	entry, tombstoned := o.lookupLocked(path, false)
+	if tombstoned || entry == nil {
+		return nil
+	}
+
+	children := make(map[string]*overlayEntry, len(entry.children))
+	for name, child := range entry.children {
+		children[name] = child
+	}
+	return children
+}
+
+// set records node (and its data, for files) at path, overwriting whatever
+// overlay state existed there before.
+func (o *overlayTree) set(path []string, node *restic.Node, data []byte) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(path) == 0 {
+		return
+	}
+	parent, _ := o.lookupLocked(path[:len(path)-1], true)
+	name := path[len(path)-1]
+	parent.children[name] = &overlayEntry{
+		node:     node,
+		data:     data,
+		children: make(map[string]*overlayEntry),
+	}
+}
+
+// remove tombstones path so that a subsequent CommitOverlay omits it from
+// the packed tree, even if it still exists in the underlying snapshot.
+func (o *overlayTree) remove(path []string) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(path) == 0 {
+		return
+	}
+	parent, _ := o.lookupLocked(path[:len(path)-1], true)
+	name := path[len(path)-1]
+	parent.children[name] = nil
+}
+
+// rename moves the overlay state at oldpath to newpath and tombstones
+// oldpath, whether or not oldpath was itself touched in the overlay
+// before. If it wasn't (it exists only in the underlying snapshot),
+// fallback — the real node the caller already resolved, e.g. from
+// dir.items — is copied up so the destination carries the moved file's
+// content instead of the rename being silently undone the next time the
+// directory is rebuilt from the repository.
+func (o *overlayTree) rename(oldpath, newpath []string, fallback *restic.Node) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	entry, tombstoned := o.lookupLocked(oldpath, false)
+
+	oldparent, _ := o.lookupLocked(oldpath[:len(oldpath)-1], true)
+	oldname := oldpath[len(oldpath)-1]
+	oldparent.children[oldname] = nil
+
+	if entry == nil && !tombstoned && fallback != nil {
+		node := *fallback
+		entry = &overlayEntry{node: &node, children: make(map[string]*overlayEntry)}
+	}
+	if entry == nil {
+		// nothing recorded at oldpath and nothing to copy up: there is no
+		// content to move, so leave the destination untouched.
+		return
+	}
+
+	newparent, _ := o.lookupLocked(newpath[:len(newpath)-1], true)
+	newname := newpath[len(newpath)-1]
+	entry.node.Name = newname
+	newparent.children[newname] = entry
+}
+
+// CommitOverlay packs every blob and tree touched by the overlay, saves a
+// new snapshot with the mounted snapshot as parent, and returns its ID.
+// It is a no-op (returning the parent ID unchanged) when nothing has been
+// written to the overlay.
+func (o *overlayTree) CommitOverlay(ctx context.Context, hostname string, paths []string, tags []string) (restic.ID, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(o.root.children) == 0 {
+		return o.parent, nil
+	}
+
+	treeID, err := o.saveEntry(ctx, o.root, o.parentTree)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
+	sn, err := restic.NewSnapshot(paths, tags, hostname, time.Now())
+	if err != nil {
+		return restic.ID{}, err
+	}
+	sn.Parent = &o.parent
+	sn.Tree = &treeID
+
+	id, err := restic.SaveSnapshot(ctx, o.repo, sn)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
+	debug.Log("CommitOverlay: saved snapshot %v with parent %v", id.Str(), o.parent.Str())
+	return id, nil
+}
+
+// saveEntry recursively packs modified blobs and saves the tree for
+// entry, merging the overlay delta with entry's real tree — loaded
+// through cache — when underlying is non-zero, so that siblings the
+// overlay never touched survive into the packed tree instead of being
+// dropped. underlying is the zero ID when entry has no backing tree in
+// the repository, e.g. a directory created by Mkdir.
+func (o *overlayTree) saveEntry(ctx context.Context, entry *overlayEntry, underlying restic.ID) (restic.ID, error) {
+	tree := restic.NewTree()
+	merged := make(map[string]bool, len(entry.children))
+
+	if underlying != (restic.ID{}) {
+		realTree, err := o.cache.get(ctx, o.repo, underlying)
+		if err != nil {
+			return restic.ID{}, err
+		}
+		for _, node := range realTree.Nodes {
+			merged[node.Name] = true
+			child, touched := entry.children[node.Name]
+			if !touched {
+				// untouched sibling: carry the real node over as-is
+				tree.Insert(node)
+				continue
+			}
+			if child == nil {
+				// tombstone: path was removed, leave it out of the tree
+				continue
+			}
+			packed, err := o.packEntry(ctx, node.Name, child, node)
+			if err != nil {
+				return restic.ID{}, err
+			}
+			tree.Insert(packed)
+		}
+	}
+
+	for name, child := range entry.children {
+		if merged[name] || child == nil {
+			continue
+		}
+		packed, err := o.packEntry(ctx, name, child, nil)
+		if err != nil {
+			return restic.ID{}, err
+		}
+		tree.Insert(packed)
+	}
+
+	id, err := o.repo.SaveTree(ctx, tree)
+	if err != nil {
+		return restic.ID{}, err
+	}
+
+	return id, nil
+}
+
+// packEntry returns the restic.Node to insert into the parent tree for
+// child, named name. realNode is the node already present at this level
+// in the underlying tree, or nil when child has no counterpart there
+// (e.g. a brand new file). Directories recurse via saveEntry, merging
+// with the underlying subtree named by realNode, or by child.node.Subtree
+// when rename copied up a real node without a sibling match at this
+// level (see overlayTree.rename).
+func (o *overlayTree) packEntry(ctx context.Context, name string, child *overlayEntry, realNode *restic.Node) (*restic.Node, error) {
+	node := *child.node
+	node.Name = name
+
+	if node.Type == "dir" {
+		var underlying restic.ID
+		if realNode != nil && realNode.Type == "dir" && realNode.Subtree != nil {
+			underlying = *realNode.Subtree
+		} else if child.node.Subtree != nil {
+			underlying = *child.node.Subtree
+		}
+		id, err := o.saveEntry(ctx, child, underlying)
+		if err != nil {
+			return nil, err
+		}
+		node.Subtree = &id
+	} else if child.data != nil {
+		// a file truncated to zero bytes must not keep its old content
+		node.Content = nil
+		node.Size = uint64(len(child.data))
+		if len(child.data) > 0 {
+			id, err := o.repo.SaveBlob(ctx, restic.DataBlob, child.data, restic.ID{})
+			if err != nil {
+				return nil, err
+			}
+			node.Content = []restic.ID{id}
+		}
+	}
+
+	return &node, nil
+}
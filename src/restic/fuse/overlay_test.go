@@ -0,0 +1,232 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"restic"
+)
+
+func TestOverlayTreeSetAndLookup(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+
+	node := &restic.Node{Name: "foo", Type: "file"}
+	o.set([]string{"dir", "foo"}, node, []byte("hello"))
+
+	entry, tombstoned := o.lookup([]string{"dir", "foo"}, false)
+	if tombstoned {
+		t.Fatal("expected a freshly set path not to be tombstoned")
+	}
+	if entry == nil || entry.node != node {
+		t.Fatalf("expected to find the node set above, got %v", entry)
+	}
+
+	if _, tombstoned := o.lookup([]string{"dir", "bar"}, false); tombstoned {
+		t.Fatal("a path that was never touched must not read as tombstoned")
+	}
+}
+
+func TestOverlayTreeRemoveIsTombstone(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+	o.set([]string{"foo"}, &restic.Node{Name: "foo", Type: "file"}, nil)
+
+	o.remove([]string{"foo"})
+
+	entry, tombstoned := o.lookup([]string{"foo"}, false)
+	if !tombstoned {
+		t.Fatal("expected a removed path to be tombstoned")
+	}
+	if entry != nil {
+		t.Fatalf("expected a tombstoned entry to be nil, got %v", entry)
+	}
+}
+
+func TestOverlayTreeChildrenAtMergesTombstones(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+	o.set([]string{"foo"}, &restic.Node{Name: "foo", Type: "file"}, nil)
+	o.set([]string{"bar"}, &restic.Node{Name: "bar", Type: "file"}, nil)
+	o.remove([]string{"bar"})
+
+	children := o.childrenAt(nil)
+	if _, ok := children["foo"]; !ok {
+		t.Fatal("expected childrenAt to include the created path")
+	}
+	barEntry, ok := children["bar"]
+	if !ok || barEntry != nil {
+		t.Fatalf("expected childrenAt to include a tombstone for a removed path, got %v, %v", barEntry, ok)
+	}
+}
+
+func TestOverlayTreeChildrenAtUntouchedPath(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+	if children := o.childrenAt([]string{"never", "touched"}); children != nil {
+		t.Fatalf("expected no recorded children for an untouched path, got %v", children)
+	}
+}
+
+func TestOverlayTreeRename(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+	node := &restic.Node{Name: "foo", Type: "file"}
+	o.set([]string{"foo"}, node, []byte("data"))
+
+	o.rename([]string{"foo"}, []string{"renamed"}, nil)
+
+	if _, tombstoned := o.lookup([]string{"foo"}, false); !tombstoned {
+		t.Fatal("expected the old path to be tombstoned after a rename")
+	}
+	entry, tombstoned := o.lookup([]string{"renamed"}, false)
+	if tombstoned || entry == nil {
+		t.Fatalf("expected the entry to show up at the new path, got %v, tombstoned=%v", entry, tombstoned)
+	}
+	if entry.node.Name != "renamed" {
+		t.Fatalf("expected rename to update node.Name, got %q", entry.node.Name)
+	}
+}
+
+func TestOverlayTreeRenameOfUntouchedPathCopiesUpAndTombstonesSource(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+
+	// oldpath was never touched in the overlay (it exists only in the
+	// underlying snapshot); the caller passes the real node it already
+	// resolved (e.g. dir.items) as fallback, which rename must copy up to
+	// newpath while tombstoning oldpath.
+	real := &restic.Node{Name: "untouched", Type: "file", Size: 4}
+	o.rename([]string{"untouched"}, []string{"renamed"}, real)
+
+	if _, tombstoned := o.lookup([]string{"untouched"}, false); !tombstoned {
+		t.Fatal("expected the source of a rename to be tombstoned")
+	}
+	entry, tombstoned := o.lookup([]string{"renamed"}, false)
+	if tombstoned || entry == nil {
+		t.Fatalf("expected the destination to carry over the real node, got %v, tombstoned=%v", entry, tombstoned)
+	}
+	if entry.node.Name != "renamed" {
+		t.Fatalf("expected rename to update node.Name, got %q", entry.node.Name)
+	}
+	if entry.node.Size != 4 {
+		t.Fatalf("expected the destination to carry over the real node's metadata, got size %v", entry.node.Size)
+	}
+}
+
+func TestOverlayTreeRenameOfTombstonedPathStaysTombstoned(t *testing.T) {
+	o := newOverlayTree(nil, restic.ID{}, restic.ID{}, nil)
+	o.remove([]string{"gone"})
+
+	o.rename([]string{"gone"}, []string{"renamed"}, &restic.Node{Name: "gone", Type: "file"})
+
+	if _, tombstoned := o.lookup([]string{"gone"}, false); !tombstoned {
+		t.Fatal("expected the removed source to stay tombstoned after a rename")
+	}
+	if _, tombstoned := o.lookup([]string{"renamed"}, false); tombstoned {
+		t.Fatal("expected renaming an already-removed path not to touch the destination")
+	}
+	if entry, _ := o.lookup([]string{"renamed"}, false); entry != nil {
+		t.Fatalf("expected no entry at the destination, got %v", entry)
+	}
+}
+
+// fakeOverlayRepo implements just enough of restic.Repository for
+// saveEntry tests: LoadTree is served from trees, SaveTree records every
+// tree it is asked to save, and SaveBlob hands out a deterministic ID.
+// Every other method panics (via the nil embedded interface) since the
+// tests below never need them.
+type fakeOverlayRepo struct {
+	restic.Repository
+	trees []*restic.Tree
+	saved []*restic.Tree
+}
+
+func (f *fakeOverlayRepo) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	return f.trees[int(id[0])], nil
+}
+
+func (f *fakeOverlayRepo) SaveBlob(ctx context.Context, t restic.BlobType, buf []byte, id restic.ID) (restic.ID, error) {
+	var blobID restic.ID
+	blobID[0] = byte(len(buf))
+	return blobID, nil
+}
+
+func (f *fakeOverlayRepo) SaveTree(ctx context.Context, tree *restic.Tree) (restic.ID, error) {
+	f.saved = append(f.saved, tree)
+	var id restic.ID
+	id[0] = byte(len(f.saved))
+	return id, nil
+}
+
+func TestOverlayTreeSaveEntryMergesUntouchedSiblings(t *testing.T) {
+	var parentTree restic.ID
+	parentTree[0] = 1
+
+	existing := restic.NewTree()
+	existing.Insert(&restic.Node{Name: "a.txt", Type: "file"})
+	existing.Insert(&restic.Node{Name: "b.txt", Type: "file"})
+
+	repo := &fakeOverlayRepo{trees: []*restic.Tree{nil, existing}}
+	o := newOverlayTree(repo, restic.ID{}, parentTree, nil)
+	o.set([]string{"c.txt"}, &restic.Node{Name: "c.txt", Type: "file"}, []byte("hello"))
+
+	if _, err := o.saveEntry(context.Background(), o.root, parentTree); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repo.saved) != 1 {
+		t.Fatalf("expected a single tree to be saved, got %v", len(repo.saved))
+	}
+	names := make(map[string]bool)
+	for _, n := range repo.saved[0].Nodes {
+		names[n.Name] = true
+	}
+	for _, want := range []string{"a.txt", "b.txt", "c.txt"} {
+		if !names[want] {
+			t.Fatalf("expected the saved tree to contain %q, got %v", want, names)
+		}
+	}
+}
+
+func TestOverlayTreeSaveEntryOmitsTombstonedSibling(t *testing.T) {
+	var parentTree restic.ID
+	parentTree[0] = 1
+
+	existing := restic.NewTree()
+	existing.Insert(&restic.Node{Name: "a.txt", Type: "file"})
+	existing.Insert(&restic.Node{Name: "b.txt", Type: "file"})
+
+	repo := &fakeOverlayRepo{trees: []*restic.Tree{nil, existing}}
+	o := newOverlayTree(repo, restic.ID{}, parentTree, nil)
+	o.remove([]string{"b.txt"})
+
+	if _, err := o.saveEntry(context.Background(), o.root, parentTree); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, n := range repo.saved[0].Nodes {
+		names[n.Name] = true
+	}
+	if !names["a.txt"] {
+		t.Fatal("expected the untouched sibling to survive")
+	}
+	if names["b.txt"] {
+		t.Fatal("expected the removed sibling to be left out of the saved tree")
+	}
+}
+
+func TestOverlayTreeCommitOverlayNoopWhenUnmodified(t *testing.T) {
+	var parent restic.ID
+	parent[0] = 42
+
+	o := newOverlayTree(nil, parent, restic.ID{}, nil)
+
+	id, err := o.CommitOverlay(context.Background(), "host", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(id, parent) {
+		t.Fatalf("expected CommitOverlay to return the parent ID unchanged when nothing was written, got %v", id)
+	}
+}
@@ -0,0 +1,45 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"restic/debug"
+)
+
+// Listxattr and Getxattr synthesize the user.restic.* xattrs describing
+// the blobs backing this file (see nodeXattrNames/nodeXattr), merged with
+// its real ExtendedAttributes, the same way dir's Listxattr/Getxattr in
+// dir.go do for a snapshot root. They live here, rather than alongside
+// file's other methods in file.go, purely for locality with the rest of
+// the xattr synthesis code.
+
+func (f *file) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	debug.Log("Listxattr(%v, %v)", f.node.Name, req.Size)
+	for _, attr := range f.node.ExtendedAttributes {
+		resp.Append(attr.Name)
+	}
+	for _, name := range nodeXattrNames {
+		resp.Append(name)
+	}
+	return nil
+}
+
+func (f *file) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	debug.Log("Getxattr(%v, %v, %v)", f.node.Name, req.Name, req.Size)
+
+	if val := nodeXattr(f.node, req.Name); val != nil {
+		resp.Xattr = val
+		return nil
+	}
+
+	attrval := f.node.GetExtendedAttribute(req.Name)
+	if attrval != nil {
+		resp.Xattr = attrval
+		return nil
+	}
+	return fuse.ErrNoXattr
+}
@@ -0,0 +1,82 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"strconv"
+	"strings"
+
+	"restic"
+)
+
+// snapshotXattrNames and snapshotXattr mirror each other: the former is
+// what Listxattr advertises, the latter is what Getxattr resolves them to.
+// Together they let tools like getfattr query a snapshot's provenance
+// without having to parse the JSON output of `restic snapshots`.
+var snapshotXattrNames = []string{
+	"user.restic.snapshot_id",
+	"user.restic.tree_id",
+	"user.restic.hostname",
+	"user.restic.tags",
+	"user.restic.paths",
+	"user.restic.time",
+}
+
+// snapshotXattr returns the value for name on a directory that is the root
+// of snapshot sn, or nil if name isn't one of snapshotXattrNames (and for
+// user.restic.tree_id when sn has no tree).
+func snapshotXattr(sn *SnapshotWithId, name string) []byte {
+	switch name {
+	case "user.restic.snapshot_id":
+		return []byte(sn.ID.String())
+	case "user.restic.tree_id":
+		if sn.Tree == nil {
+			return nil
+		}
+		return []byte(sn.Tree.String())
+	case "user.restic.hostname":
+		return []byte(sn.Hostname)
+	case "user.restic.tags":
+		return []byte(strings.Join(sn.Tags, ","))
+	case "user.restic.paths":
+		return []byte(strings.Join(sn.Paths, ":"))
+	case "user.restic.time":
+		return []byte(sn.Time.Format(timeLayout))
+	default:
+		return nil
+	}
+}
+
+// timeLayout is RFC3339 with nanoseconds, the same precision restic uses
+// when printing snapshot times elsewhere.
+const timeLayout = "2006-01-02T15:04:05.000000000-07:00"
+
+// nodeXattrNames and nodeXattr mirror each other the same way
+// snapshotXattrNames/snapshotXattr do, but describe the blobs backing a
+// regular file's restic.Node rather than a snapshot root. They are
+// consumed by file's Listxattr/Getxattr in xattr_file.go.
+var nodeXattrNames = []string{
+	"user.restic.blobs",
+	"user.restic.size",
+	"user.restic.content_ids",
+}
+
+// nodeXattr returns the value for name on node, or nil if name isn't one
+// of nodeXattrNames.
+func nodeXattr(node *restic.Node, name string) []byte {
+	switch name {
+	case "user.restic.blobs":
+		return []byte(strconv.Itoa(len(node.Content)))
+	case "user.restic.size":
+		return []byte(strconv.FormatUint(node.Size, 10))
+	case "user.restic.content_ids":
+		ids := make([]string, len(node.Content))
+		for i, id := range node.Content {
+			ids[i] = id.String()
+		}
+		return []byte(strings.Join(ids, ","))
+	default:
+		return nil
+	}
+}
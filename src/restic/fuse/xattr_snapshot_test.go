@@ -0,0 +1,84 @@
+// +build !openbsd
+// +build !windows
+
+package fuse
+
+import (
+	"testing"
+	"time"
+
+	"restic"
+)
+
+func TestSnapshotXattr(t *testing.T) {
+	var id, tree restic.ID
+	id[0], tree[0] = 1, 2
+	when := time.Date(2021, time.March, 5, 12, 0, 0, 0, time.UTC)
+	sn := &SnapshotWithId{
+		Snapshot: restic.Snapshot{
+			Hostname: "myhost",
+			Tags:     []string{"a", "b"},
+			Paths:    []string{"/srv", "/home"},
+			Time:     when,
+			Tree:     &tree,
+		},
+		ID: id,
+	}
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"user.restic.snapshot_id", id.String()},
+		{"user.restic.tree_id", tree.String()},
+		{"user.restic.hostname", "myhost"},
+		{"user.restic.tags", "a,b"},
+		{"user.restic.paths", "/srv:/home"},
+		{"user.restic.time", when.Format(timeLayout)},
+	}
+	for _, c := range cases {
+		got := snapshotXattr(sn, c.name)
+		if string(got) != c.want {
+			t.Errorf("snapshotXattr(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	if got := snapshotXattr(sn, "user.restic.bogus"); got != nil {
+		t.Errorf("expected nil for an unknown xattr name, got %q", got)
+	}
+}
+
+func TestSnapshotXattrNilTree(t *testing.T) {
+	sn := &SnapshotWithId{}
+	if got := snapshotXattr(sn, "user.restic.tree_id"); got != nil {
+		t.Errorf("expected nil tree_id when sn.Tree is nil, got %q", got)
+	}
+}
+
+func TestNodeXattr(t *testing.T) {
+	var id1, id2 restic.ID
+	id1[0], id2[0] = 1, 2
+	node := &restic.Node{
+		Size:    1234,
+		Content: []restic.ID{id1, id2},
+	}
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"user.restic.blobs", "2"},
+		{"user.restic.size", "1234"},
+		{"user.restic.content_ids", id1.String() + "," + id2.String()},
+	}
+	for _, c := range cases {
+		got := nodeXattr(node, c.name)
+		if string(got) != c.want {
+			t.Errorf("nodeXattr(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	if got := nodeXattr(node, "user.restic.bogus"); got != nil {
+		t.Errorf("expected nil for an unknown xattr name, got %q", got)
+	}
+}